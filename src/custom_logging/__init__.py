@@ -25,13 +25,24 @@ def rename_event_key(_: WrappedLogger, __: str, event_dict: EventDict) -> EventD
     return event_dict
 
 
-def setup_logging(log_level: str = "INFO") -> None:
-    """Set up JSON or pretty logging based on whether or not this is a TTY."""
+def setup_logging(
+    log_level: str = "INFO",
+    log_format: str = "auto",
+    extra_processors: list[Processor] | None = None,
+) -> None:
+    """Set up JSON or pretty logging.
+
+    The "auto" format picks pretty logging when stdout is a TTY and JSON
+    otherwise. Extra processors (such as redaction) run on every entry before
+    it is rendered. May be called again to reconfigure logging.
+    """
     console_timestamper = structlog.processors.TimeStamper(fmt="%Y-%m-%d %H:%M:%S")
     iso_timestamper = structlog.processors.TimeStamper(fmt="iso")
     # Shared processors will be used by logging entries that originate from
     # either `logging` or `structlog`.
     shared_processors: list[Processor] = [
+        # Add fields bound with `structlog.contextvars.bind_contextvars`.
+        structlog.contextvars.merge_contextvars,
         # Add log level to event dict.
         structlog.stdlib.add_log_level,
         # Perform %-style formatting.
@@ -40,8 +51,12 @@ def setup_logging(log_level: str = "INFO") -> None:
         # so that values passed in the extra parameter of log methods pass
         # through to log output.
         structlog.stdlib.ExtraAdder(),
+        *(extra_processors or []),
     ]
-    if sys.__stdout__ is not None and sys.__stdout__.isatty():
+    if log_format == "auto":
+        is_tty = sys.__stdout__ is not None and sys.__stdout__.isatty()
+        log_format = "text" if is_tty else "json"
+    if log_format == "text":
         # Set our renderer for ProcessorFormatter.
         log_renderer: Processor = structlog.dev.ConsoleRenderer()
         # Add TTY processors.
@@ -103,6 +118,8 @@ def setup_logging(log_level: str = "INFO") -> None:
     # Use OUR `ProcessorFormatter` to format all `logging` entries.
     handler.setFormatter(formatter)
     root_logger = logging.getLogger()
+    # Replace the handler from any earlier call.
+    root_logger.handlers.clear()
     root_logger.addHandler(handler)
     root_logger.setLevel(log_level.upper())
 
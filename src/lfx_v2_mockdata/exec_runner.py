@@ -0,0 +1,129 @@
+# Copyright The Linux Foundation and each contributor to LFX.
+# SPDX-License-Identifier: MIT
+
+"""Run playbooks of type 'exec'."""
+
+import json
+import os
+import subprocess
+import time
+
+from . import (
+    ExecPlaybookParams,
+    JMESPathEncoder,
+    UnresolvedReferenceError,
+    add_simulated_fields,
+    args,
+    bind_step_context,
+    fail_step,
+    get_delay_seconds,
+    is_step_condition_met,
+    logger,
+    print_dry_run_request,
+    record_step_result,
+    record_unresolved_ref,
+    retries_remaining,
+)
+
+
+def run_exec_playbook(name: str, playbook: dict) -> None:
+    """Run a playbook of type 'exec'.
+
+    Stdout is stored in `_response`, parsed as JSON when possible.
+    """
+    cli_args = args.get()
+    if "params" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing params", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing params")
+    params = ExecPlaybookParams.model_validate_json(
+        json.dumps(
+            playbook["params"],
+            cls=JMESPathEncoder,
+            separators=(",", ":"),
+        )
+    )
+    if "steps" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing steps", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing steps")
+    for step_index, step_payload in enumerate(playbook["steps"]):
+        if "_response" in step_payload:
+            # Skip steps that have already been run.
+            continue
+        bind_step_context(step_index, step_payload)
+        if not is_step_condition_met(step_payload):
+            continue
+        try:
+            step = json.loads(
+                json.dumps(
+                    {
+                        key: value
+                        for key, value in step_payload.items()
+                        if key in ["args", "env", "json", "raw"]
+                    },
+                    cls=JMESPathEncoder,
+                )
+            )
+        except AttributeError as e:
+            if cli_args.dry_run:
+                if cli_args.force:
+                    logger.error(
+                        "Error processing playbook", error=str(e), playbook=name
+                    )
+                    step_payload["_response"] = {}
+                    continue
+                else:
+                    raise
+            else:
+                if retries_remaining.get() > 0:
+                    continue
+                if cli_args.strict and isinstance(e, UnresolvedReferenceError):
+                    record_unresolved_ref(e, name, step_index)
+                    continue
+                fail_step(name, e, "Error processing playbook")
+                continue
+        command = params.command + [str(arg) for arg in step.get("args", [])]
+        stdin = None
+        if "json" in step:
+            stdin = json.dumps(step["json"], separators=(",", ":"))
+        elif "raw" in step:
+            stdin = str(step["raw"])
+
+        if cli_args.dry_run:
+            # If we're in a dry-run, print the command instead of running it.
+            print_dry_run_request(
+                name, step_index, "EXEC " + " ".join(command), {}, stdin
+            )
+            step_payload["_response"] = {}
+            continue
+        if cli_args.simulate:
+            step_payload["_response"] = add_simulated_fields(name, step_index, {})
+            record_step_result(name, "succeeded")
+            continue
+
+        time.sleep(get_delay_seconds(step_payload.get("_delay")))
+        logger.info("Running command", playbook=name, command=command)
+        try:
+            result = subprocess.run(
+                command,
+                input=stdin,
+                capture_output=True,
+                text=True,
+                env=os.environ | params.env | step.get("env", {}),
+                cwd=params.cwd,
+                timeout=params.timeout,
+                check=True,
+            )
+        except (OSError, subprocess.SubprocessError) as e:
+            stderr = getattr(e, "stderr", None)
+            fail_step(name, e, "Command failed", step_payload, stderr=stderr)
+            continue
+        try:
+            step_payload["_response"] = json.loads(result.stdout)
+        except json.decoder.JSONDecodeError:
+            # If the output is not JSON, store it as a string.
+            step_payload["_response"] = result.stdout.strip()
+        record_step_result(name, "succeeded")
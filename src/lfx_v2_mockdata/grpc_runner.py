@@ -0,0 +1,62 @@
+# Copyright The Linux Foundation and each contributor to LFX.
+# SPDX-License-Identifier: MIT
+
+"""Run playbooks of type 'grpc'."""
+
+import json
+import shutil
+
+from . import GrpcPlaybookParams, JMESPathEncoder, args, logger
+from .exec_runner import run_exec_playbook
+
+
+def run_grpc_playbook(name: str, playbook: dict) -> None:
+    """Run a playbook of type 'grpc'.
+
+    Each step's 'json' is the request message. The steps are run as an exec
+    playbook calling grpcurl (which must be in $PATH), so responses are
+    stored the same way.
+    """
+    cli_args = args.get()
+    if "params" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing params", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing params")
+    params = GrpcPlaybookParams.model_validate_json(
+        json.dumps(
+            playbook["params"],
+            cls=JMESPathEncoder,
+            separators=(",", ":"),
+        )
+    )
+    # Check for grpcurl up front, rather than failing each step with a bare
+    # FileNotFoundError. Dry and simulated runs never call it.
+    if not (cli_args.dry_run or cli_args.simulate) and not shutil.which("grpcurl"):
+        if cli_args.force:
+            logger.error("grpcurl not found in $PATH", playbook=name)
+            return
+        raise ValueError(
+            f"Playbook '{name}' needs grpcurl in $PATH (see "
+            "https://github.com/fullstorydev/grpcurl#installation)"
+        )
+    command = ["grpcurl", "-format", "json"]
+    if params.plaintext:
+        command.append("-plaintext")
+    for import_path in params.import_paths:
+        command.extend(["-import-path", import_path])
+    for proto in params.proto:
+        command.extend(["-proto", proto])
+    for protoset in params.protoset:
+        command.extend(["-protoset", protoset])
+    for key, value in params.headers.items():
+        command.extend(["-H", f"{key}: {value}"])
+    if params.timeout is not None:
+        command.extend(["-max-time", str(params.timeout)])
+    # Read the request message from stdin.
+    command.extend(["-d", "@", params.address, params.method])
+    exec_playbook = {"params": {"command": command, "timeout": params.timeout}}
+    if "steps" in playbook:
+        # Share the step objects so responses are stored on this playbook.
+        exec_playbook["steps"] = playbook["steps"]
+    run_exec_playbook(name, exec_playbook)
@@ -0,0 +1,667 @@
+# Copyright The Linux Foundation and each contributor to LFX.
+# SPDX-License-Identifier: MIT
+
+"""Run playbooks of type 'http-request'."""
+
+import fnmatch
+import json
+import os
+import time
+import uuid
+from http import HTTPMethod, HTTPStatus
+from typing import Any
+
+import jmespath
+import requests
+import yaml
+from pydantic import ValidationError
+
+from . import (
+    RESOURCE_MODELS,
+    YAML_MEDIA_TYPES,
+    HttpLookupParams,
+    HttpRequestPlaybookParams,
+    JMESPathEncoder,
+    MultipartFile,
+    ResponseExpectationError,
+    UnresolvedReferenceError,
+    add_simulated_fields,
+    apply_auth_headers,
+    args,
+    bind_step_context,
+    capture_exchange,
+    check_field_formats,
+    check_response_expectations,
+    fail_step,
+    get_cookie_jar,
+    get_delay_seconds,
+    get_http_session,
+    get_proxies,
+    get_rate_limit_delay,
+    get_request_timeout,
+    get_request_url,
+    get_tls_options,
+    is_step_condition_met,
+    logger,
+    print_dry_run_request,
+    record_http_status,
+    record_step_result,
+    record_unresolved_ref,
+    redact_headers,
+    retries_remaining,
+    store_cookies,
+)
+
+# Relations of the --fga-model authorization model, by object type and then
+# relation, listing the user types that may be directly assigned.
+fga_model_relations: None | dict[str, dict[str, list[str]]] = None
+
+
+def run_http_request_playbook(name: str, playbook: dict) -> None:
+    """Run a playbook of type 'http-request'."""
+    cli_args = args.get()
+    if "params" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing params", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing params")
+    playbook_params = HttpRequestPlaybookParams.model_validate_json(
+        json.dumps(
+            playbook["params"],
+            cls=JMESPathEncoder,
+            separators=(",", ":"),
+        )
+    )
+    try:
+        apply_auth_headers(playbook_params)
+    except ValueError as e:
+        if cli_args.force:
+            logger.error("Invalid auth params", error=str(e), playbook=name)
+            return
+        raise
+    if "steps" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing steps", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing steps")
+    for step_index, step_payload in enumerate(playbook["steps"]):
+        if "_response" in step_payload:
+            # Skip steps that have already been run.
+            continue
+        bind_step_context(step_index, step_payload)
+        if not is_step_condition_met(step_payload):
+            continue
+
+        # Determine payload type and prepare data.
+        params = playbook_params
+        request_data = None
+        files = None
+        query_params = dict(params.params)
+        try:
+            params = get_step_request_params(playbook_params, step_payload)
+            if "_params" in step_payload:
+                # Per-step query parameters override the playbook's.
+                step_params = json.loads(
+                    json.dumps(step_payload["_params"], cls=JMESPathEncoder)
+                )
+                query_params.update(
+                    {key: str(value) for key, value in step_params.items()}
+                )
+            if params.method in [HTTPMethod.POST, HTTPMethod.PUT, HTTPMethod.PATCH]:
+                body_key = "json" if "json" in step_payload else "form"
+                encode_json = params.body_type in ["json", "raw"] or (
+                    params.body_type is None
+                    and body_key == "json"
+                    and "_file" not in step_payload
+                )
+                if body_key in step_payload and params.body_type == "yaml":
+                    params.headers["content-type"] = "application/yaml"
+                    request_data = yaml.safe_dump(
+                        json.loads(
+                            json.dumps(step_payload[body_key], cls=JMESPathEncoder)
+                        ),
+                        sort_keys=False,
+                        allow_unicode=True,
+                    )
+                elif body_key in step_payload and encode_json:
+                    if params.body_type != "raw":
+                        params.headers["content-type"] = "application/json"
+                    request_data = json.dumps(
+                        step_payload[body_key],
+                        cls=JMESPathEncoder,
+                        separators=(",", ":"),
+                    )
+                    if params.resource is not None:
+                        # Catch template bugs before anything is uploaded.
+                        RESOURCE_MODELS[params.resource].model_validate_json(
+                            request_data
+                        )
+                elif body_key in step_payload:
+                    processed_data = json.dumps(
+                        step_payload[body_key],
+                        cls=JMESPathEncoder,
+                        separators=(",", ":"),
+                    )
+                    # Convert back to a dict; requests will handle form (or
+                    # multipart) encoding.
+                    request_data = json.loads(processed_data)
+                if params.body_type == "multipart" or "_file" in step_payload:
+                    files = {
+                        field: MultipartFile.model_validate(
+                            {"path": file} if isinstance(file, str) else file
+                        )
+                        for field, file in json.loads(
+                            json.dumps(
+                                step_payload.get("_file", {}), cls=JMESPathEncoder
+                            )
+                        ).items()
+                    }
+                    # Multipart fields are strings; encode anything else as JSON.
+                    request_data = {
+                        key: value if isinstance(value, str) else json.dumps(value)
+                        for key, value in (request_data or {}).items()
+                    }
+        except AttributeError as e:
+            if cli_args.dry_run:
+                if cli_args.force:
+                    logger.error(
+                        "Error processing playbook", error=str(e), playbook=name
+                    )
+                    step_payload["_response"] = {}
+                    continue
+                else:
+                    raise
+            else:
+                if retries_remaining.get() > 0:
+                    continue
+                if cli_args.strict and isinstance(e, UnresolvedReferenceError):
+                    record_unresolved_ref(e, name, step_index)
+                    continue
+                fail_step(name, e, "Error processing playbook")
+                continue
+        except ValidationError as e:
+            fail_step(name, e, "Step failed resource validation", step_payload)
+            continue
+        if params.method in [HTTPMethod.POST, HTTPMethod.PUT, HTTPMethod.PATCH]:
+            if request_data is None and "raw" in step_payload:
+                if isinstance(step_payload["raw"], str):
+                    request_data = step_payload["raw"]
+                else:
+                    request_data = str(step_payload["raw"])
+            if params.content_type is not None and files is None:
+                params.headers["content-type"] = params.content_type
+
+        # How the request body is shown, with uploads as "@path" like curl.
+        request_body = request_data
+        if files is not None:
+            request_body = request_data | {
+                field: f"@{file.path}" for field, file in files.items()
+            }
+
+        try:
+            url = get_request_url(params, step_payload)
+        except ValueError as e:
+            fail_step(name, e, "Invalid request URL", step_payload)
+            continue
+
+        if cli_args.dry_run or cli_args.simulate:
+            try:
+                raise_simulated_failure(name, url)
+            except requests.exceptions.HTTPError as e:
+                fail_step(name, e, "Request failed", step_payload)
+                continue
+
+        if cli_args.dry_run:
+            # If we're in a dry-run, print the request instead of sending it.
+            prepared_url = (
+                requests.Request(params.method, url, params=query_params)
+                .prepare()
+                .url
+            )
+            print_dry_run_request(
+                name,
+                step_index,
+                f"{params.method} {prepared_url}",
+                params.headers,
+                request_body,
+            )
+            step_payload["_response"] = {}
+            continue
+        if "json" in step_payload and isinstance(request_data, str):
+            payload = json.loads(request_data)
+            payload_errors = check_field_formats(playbook, payload)
+            payload_errors.extend(check_fga_tuples(payload))
+            if payload_errors:
+                error = ValueError(
+                    f"Playbook '{name}' step {step_index} payload is invalid: "
+                    f"{'; '.join(payload_errors)}"
+                )
+                fail_step(name, error, "Step payload is invalid", step_payload)
+                continue
+
+        if cli_args.simulate:
+            step_payload["_response"] = add_simulated_fields(
+                name, step_index, simulate_http_response(request_data)
+            )
+            step_payload["_response_meta"] = {
+                "status": HTTPStatus.OK.value,
+                "headers": {},
+                "duration_ms": 0,
+            }
+            record_step_result(name, "succeeded")
+            continue
+
+        if params.exists_check is not None:
+            try:
+                existing_resource = find_existing_resource(params, step_payload)
+            except (
+                requests.exceptions.RequestException,
+                json.decoder.JSONDecodeError,
+            ) as e:
+                fail_step(name, e, "Exists check failed", step_payload)
+                continue
+            if existing_resource is not None:
+                logger.info("Skipping step for existing resource", playbook=name)
+                # Not counted as succeeded, so the run report lists it as skipped.
+                step_payload["_response"] = existing_resource
+                continue
+
+        request_files = None
+        if files is not None:
+            request_files = {}
+            try:
+                for field, file in files.items():
+                    with open(file.path, "rb") as f:
+                        request_files[field] = (
+                            file.filename or os.path.basename(file.path),
+                            f.read(),
+                            file.content_type,
+                        )
+            except OSError as e:
+                fail_step(name, e, "Failed to read upload", step_payload)
+                continue
+
+        time.sleep(get_delay_seconds(step_payload.get("_delay")))
+        time.sleep(get_rate_limit_delay(name, playbook))
+        logger.info(
+            "Running step",
+            playbook=name,
+            method=params.method,
+            url=url,
+            data=request_body,
+        )
+
+        try:
+            response = get_http_session().request(
+                method=params.method,
+                url=url,
+                headers=params.headers,
+                params=query_params,
+                data=request_data,
+                files=request_files,
+                cookies=get_cookie_jar(params),
+                timeout=get_request_timeout(params.timeout),
+                proxies=get_proxies(params.proxy),
+                **get_tls_options(params.tls),
+            )
+            store_cookies(params, response)
+            capture_exchange(
+                name,
+                step_index,
+                {
+                    "method": params.method,
+                    "url": response.request.url,
+                    "headers": redact_headers(params.headers),
+                    "body": request_body,
+                },
+                {
+                    "status": response.status_code,
+                    "headers": redact_headers(response.headers),
+                    "body": response.text,
+                },
+            )
+            record_http_status(response.status_code)
+            check_response_status(params, response)
+            looked_up = False
+            if not response.ok and params.lookup is not None:
+                logger.info(
+                    "Looking up existing resource",
+                    playbook=name,
+                    status=response.status_code,
+                )
+                response = run_http_lookup(params, params.lookup, step_payload)
+                looked_up = True
+            paginated_items = None
+            if params.paginate is not None and params.method == HTTPMethod.GET:
+                paginated_items = fetch_all_pages(
+                    name, params, url, query_params, response
+                )
+            check_response_expectations(
+                name,
+                playbook,
+                response.elapsed.total_seconds() * 1000,
+                len(response.content),
+            )
+            # Store the response in the playbook for future reference.
+        except ResponseExpectationError as e:
+            fail_step(name, e, "Response exceeded budget", step_payload)
+            continue
+        except requests.exceptions.RequestException as e:
+            if e.response is None:
+                capture_exchange(
+                    name,
+                    step_index,
+                    {
+                        "method": params.method,
+                        "url": url,
+                        "headers": redact_headers(params.headers),
+                        "body": request_body,
+                    },
+                    {"error": str(e)},
+                )
+            fail_step(name, e, "Request failed", step_payload)
+            continue
+        try:
+            r_dict = response.json()
+            if looked_up and params.lookup.path is not None:
+                r_dict = jmespath.search(params.lookup.path, r_dict)
+            if paginated_items is not None:
+                r_dict = {"items": paginated_items}
+            step_payload["_response"] = r_dict
+            # Keep response details such as Location or ETag for !ref, with
+            # lowercase header names so references do not depend on casing.
+            response_headers = redact_headers(response.headers)
+            step_payload["_response_meta"] = {
+                "status": response.status_code,
+                "headers": {
+                    key.lower(): value for key, value in response_headers.items()
+                },
+                "duration_ms": round(response.elapsed.total_seconds() * 1000),
+            }
+            record_step_result(name, "succeeded")
+        except json.decoder.JSONDecodeError as e:
+            fail_step(name, e, "Failed to parse response as JSON", step_payload)
+            continue
+
+
+def get_fga_model_relations() -> dict[str, dict[str, list[str]]]:
+    """Load the --fga-model file, if any, into fga_model_relations.
+
+    The file is an OpenFGA authorization model in JSON (as output by
+    `fga model transform` or the authorization-models API). Allowed user
+    types are listed as "type", "type:*" (wildcard) or "type#relation".
+    """
+    global fga_model_relations
+    if fga_model_relations is None:
+        fga_model_relations = {}
+        model_path = args.get().fga_model
+        if model_path is None:
+            return fga_model_relations
+        with open(model_path, encoding="utf-8") as f:
+            model = json.load(f)
+        model = model.get("authorization_model", model)
+        for type_definition in model.get("type_definitions", []):
+            relations = type_definition.get("relations") or {}
+            relations_metadata = (type_definition.get("metadata") or {}).get(
+                "relations"
+            ) or {}
+            fga_model_relations[type_definition["type"]] = {}
+            for relation in relations:
+                user_types = []
+                for user_type in relations_metadata.get(relation, {}).get(
+                    "directly_related_user_types", []
+                ):
+                    if "wildcard" in user_type:
+                        user_types.append(f"{user_type['type']}:*")
+                    elif "relation" in user_type:
+                        user_types.append(
+                            f"{user_type['type']}#{user_type['relation']}"
+                        )
+                    else:
+                        user_types.append(user_type["type"])
+                fga_model_relations[type_definition["type"]][relation] = user_types
+    return fga_model_relations
+
+
+def check_fga_tuples(payload: Any) -> list[str]:
+    """Check the tuples of an OpenFGA write request against --fga-model.
+
+    Returns a description of each invalid tuple; the list is empty if the
+    payload is valid, is not a write request, or no model was given.
+    """
+    model_relations = get_fga_model_relations()
+    if not model_relations or not isinstance(payload, dict):
+        return []
+    tuple_keys = (payload.get("writes") or {}).get("tuple_keys") or []
+    errors = []
+    for tuple_key in tuple_keys:
+        user = str(tuple_key.get("user", ""))
+        relation = str(tuple_key.get("relation", ""))
+        object_type = str(tuple_key.get("object", "")).partition(":")[0]
+        if object_type not in model_relations:
+            errors.append(f"unknown object type '{object_type}'")
+            continue
+        if relation not in model_relations[object_type]:
+            errors.append(f"'{object_type}' has no relation '{relation}'")
+            continue
+        user_type, _, user_id = user.partition(":")
+        user_object_id, _, user_relation = user_id.partition("#")
+        if user_relation:
+            user_type = f"{user_type}#{user_relation}"
+        elif user_object_id == "*":
+            user_type = f"{user_type}:*"
+        if user_type not in model_relations[object_type][relation]:
+            errors.append(
+                f"'{user}' cannot be directly assigned '{object_type}#{relation}'"
+            )
+    return errors
+
+
+def check_response_status(
+    params: HttpRequestPlaybookParams, response: requests.Response
+) -> None:
+    """Raise HTTPError unless the status is a success for this playbook."""
+    if params.success_status is None:
+        response.raise_for_status()
+    elif response.status_code not in params.success_status:
+        raise requests.exceptions.HTTPError(
+            f"{response.status_code} status is not in success_status for url: "
+            f"{response.url}",
+            response=response,
+        )
+
+
+def run_http_lookup(
+    params: HttpRequestPlaybookParams, lookup: HttpLookupParams, step_payload: dict
+) -> requests.Response:
+    """Send a lookup or exists_check request for a step, raising on error."""
+    lookup_params = params.model_copy(update={"url": lookup.url})
+    response = get_http_session().request(
+        method=lookup.method,
+        url=get_request_url(lookup_params, step_payload),
+        headers=params.headers,
+        params=lookup.params,
+        cookies=get_cookie_jar(params),
+        timeout=get_request_timeout(params.timeout),
+        proxies=get_proxies(params.proxy),
+        **get_tls_options(params.tls),
+    )
+    store_cookies(params, response)
+    record_http_status(response.status_code)
+    response.raise_for_status()
+    return response
+
+
+def fetch_all_pages(
+    name: str,
+    params: HttpRequestPlaybookParams,
+    url: str,
+    query_params: dict[str, str],
+    response: requests.Response,
+) -> list[Any]:
+    """Collect the items of a paginated GET response and all following pages."""
+    paginate = params.paginate
+    page_params = dict(query_params)
+    items: list[Any] = []
+    for page_number in range(1, paginate.max_pages + 1):
+        body = response.json()
+        page_items = jmespath.search(paginate.items, body) or []
+        items.extend(page_items)
+        if paginate.next_token is not None:
+            next_token = jmespath.search(paginate.next_token, body)
+            if not next_token:
+                break
+            page_params[paginate.token_param] = str(next_token)
+        elif paginate.page_param is not None and page_items:
+            page = int(page_params.get(paginate.page_param, "1"))
+            page_params[paginate.page_param] = str(page + 1)
+        elif paginate.offset_param is not None and page_items:
+            offset = int(page_params.get(paginate.offset_param, "0"))
+            page_params[paginate.offset_param] = str(offset + len(page_items))
+        else:
+            break
+        if page_number == paginate.max_pages:
+            logger.warning(
+                "Stopped paginating at max_pages",
+                playbook=name,
+                max_pages=paginate.max_pages,
+            )
+            break
+        response = get_http_session().get(
+            url,
+            headers=params.headers,
+            params=page_params,
+            cookies=get_cookie_jar(params),
+            timeout=get_request_timeout(params.timeout),
+            proxies=get_proxies(params.proxy),
+            **get_tls_options(params.tls),
+        )
+        store_cookies(params, response)
+        record_http_status(response.status_code)
+        check_response_status(params, response)
+    return items
+
+
+def find_existing_resource(
+    params: HttpRequestPlaybookParams, step_payload: dict
+) -> Any:
+    """Run a playbook's exists_check for a step.
+
+    Returns the existing resource, or None if it does not exist (including
+    when the check responds 404).
+    """
+    exists_check = params.exists_check
+    try:
+        response = run_http_lookup(params, exists_check, step_payload)
+    except requests.exceptions.HTTPError as e:
+        if e.response is not None and e.response.status_code == 404:
+            return None
+        raise
+    result = jmespath.search(exists_check.path or "@", response.json())
+    if exists_check.key is None:
+        return result or None
+    fields = json.loads(json.dumps(step_payload.get("json", {}), cls=JMESPathEncoder))
+    for item in result if isinstance(result, list) else []:
+        if isinstance(item, dict) and item.get(exists_check.key) == fields.get(
+            exists_check.key
+        ):
+            return item
+    return None
+
+
+def raise_simulated_failure(name: str, url: str) -> None:
+    """Raise HTTPError if --simulate-failure matches the playbook name."""
+    for pattern, status_code in args.get().simulate_failures.items():
+        if not fnmatch.fnmatchcase(name, pattern):
+            continue
+        response = requests.Response()
+        response.status_code = status_code
+        response.url = url
+        if status_code in HTTPStatus:
+            response.reason = HTTPStatus(status_code).phrase
+        record_http_status(status_code)
+        response.raise_for_status()
+
+
+def simulate_http_response(request_data: Any) -> dict[str, Any]:
+    """Fabricate a response for --simulate by echoing the request body.
+
+    A new UUID is added as "uid", and also fills any "id" or "*_uid" field
+    that is missing a value.
+    """
+    if isinstance(request_data, str):
+        try:
+            request_data = json.loads(request_data)
+        except json.decoder.JSONDecodeError:
+            pass
+    response = dict(request_data) if isinstance(request_data, dict) else {}
+    response["uid"] = str(uuid.uuid4())
+    for key, value in response.items():
+        if value is None and (key == "id" or key.endswith("_uid")):
+            response[key] = str(uuid.uuid4())
+    return response
+
+
+def get_step_request_params(
+    params: HttpRequestPlaybookParams, step_payload: dict
+) -> HttpRequestPlaybookParams:
+    """Apply a step's `_method`, `_url`, `_headers` and `_timeout` overrides.
+
+    The overrides may use !ref and !sub; headers are merged over the
+    playbook's headers. A `_content_type` hint sets both the body type and
+    the Content-Type header (see get_body_type). The returned params always
+    have their own headers, so that a step can set its content type without
+    changing the headers of later steps.
+    """
+    overrides = json.loads(
+        json.dumps(
+            {
+                key: value
+                for key, value in step_payload.items()
+                if key in ["_method", "_url", "_headers", "_timeout", "_content_type"]
+            },
+            cls=JMESPathEncoder,
+        )
+    )
+    update: dict[str, Any] = {"headers": dict(params.headers)}
+    if "_method" in overrides:
+        update["method"] = HTTPMethod(str(overrides["_method"]).upper())
+    if "_url" in overrides:
+        update["url"] = str(overrides["_url"])
+    if "_headers" in overrides:
+        update["headers"] |= {
+            key: str(value) for key, value in overrides["_headers"].items()
+        }
+    if "_timeout" in overrides:
+        update["timeout"] = float(overrides["_timeout"])
+    if "_content_type" in overrides:
+        update["content_type"] = str(overrides["_content_type"])
+        update["body_type"] = get_body_type(update["content_type"])
+        if update["body_type"] == "multipart":
+            # Requests sets the header, with the part boundary.
+            update["content_type"] = None
+            update["headers"] = {
+                key: value
+                for key, value in update["headers"].items()
+                if key.lower() != "content-type"
+            }
+    return params.model_copy(update=update)
+
+
+def get_body_type(content_type: str) -> str:
+    """Return the body type that encodes a body for a Content-Type.
+
+    JSON media types (including "+json" suffixes) are "json", urlencoded forms
+    are "form", multipart forms are "multipart" and YAML media types are
+    "yaml"; anything else is sent as "raw" JSON text.
+    """
+    media_type = content_type.partition(";")[0].strip().lower()
+    if media_type == "application/json" or media_type.endswith("+json"):
+        return "json"
+    if media_type == "application/x-www-form-urlencoded":
+        return "form"
+    if media_type == "multipart/form-data":
+        return "multipart"
+    if media_type in YAML_MEDIA_TYPES or media_type.endswith("+yaml"):
+        return "yaml"
+    return "raw"
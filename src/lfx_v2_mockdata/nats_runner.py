@@ -0,0 +1,640 @@
+# Copyright The Linux Foundation and each contributor to LFX.
+# SPDX-License-Identifier: MIT
+
+"""Run playbooks of the NATS types.
+
+These are 'nats-publish', 'nats-kv-put', 'nats-request' and 'nats-expect'.
+"""
+
+import asyncio
+import json
+import os
+import time
+import uuid
+
+import jmespath
+import nats
+import structlog
+from nats.aio.client import Client as NatsClient
+from nats.errors import TimeoutError
+from nats.js import JetStreamContext
+from nats.js.api import ConsumerConfig, DeliverPolicy
+
+from . import (
+    JMESPathEncoder,
+    NatsExpectPlaybookParams,
+    NatsKvPutPlaybookParams,
+    NatsPublishPlaybookParams,
+    NatsRequestPlaybookParams,
+    UnresolvedReferenceError,
+    add_simulated_fields,
+    args,
+    bind_step_context,
+    capture_exchange,
+    check_field_formats,
+    check_response_expectations,
+    fail_step,
+    get_delay_seconds,
+    get_rate_limit_delay,
+    is_step_condition_met,
+    logger,
+    print_dry_run_request,
+    record_step_result,
+    record_unresolved_ref,
+    retries_remaining,
+    run_started_at,
+)
+
+# NATS connection variables.
+nats_client: None | NatsClient = None
+jetstream_client: None | JetStreamContext = None
+
+# NATS configuration.
+NATS_URL = os.getenv("NATS_URL", "nats://nats:4222")
+
+
+async def initialize_nats_connection() -> None:
+    """Initialize NATS client connection if not already connected."""
+    global nats_client, jetstream_client
+    if nats_client is None:
+        try:
+            nats_client = await nats.connect(NATS_URL, max_reconnect_attempts=3)
+            jetstream_client = nats_client.jetstream()
+            logger.info("Connected to NATS", url=NATS_URL)
+        except Exception as e:
+            logger.error("Failed to connect to NATS", error=str(e))
+            raise
+
+
+async def cleanup_nats_connection() -> None:
+    """Clean up NATS client connection."""
+    global nats_client, jetstream_client
+    if nats_client is not None:
+        await nats_client.close()
+        nats_client = None
+        jetstream_client = None
+        logger.info("Disconnected from NATS")
+
+
+async def run_nats_publish_playbook(name: str, playbook: dict) -> None:
+    """Run a playbook of type 'nats-publish'."""
+    cli_args = args.get()
+
+    # Initialize NATS connection if needed (simulated runs never connect).
+    if not cli_args.simulate:
+        await initialize_nats_connection()
+        if nats_client is None:
+            if cli_args.force:
+                logger.error("NATS client not connected", playbook=name)
+                return
+            raise AttributeError("NATS client not connected")
+
+    if "params" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing params", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing params")
+
+    params = NatsPublishPlaybookParams.model_validate_json(
+        json.dumps(
+            playbook["params"],
+            cls=JMESPathEncoder,
+            separators=(",", ":"),
+        )
+    )
+
+    if "steps" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing steps", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing steps")
+
+    for step_index, step_payload in enumerate(playbook["steps"]):
+        if "_response" in step_payload:
+            # Skip steps that have already been run.
+            continue
+        bind_step_context(step_index, step_payload)
+        if not is_step_condition_met(step_payload):
+            continue
+
+        # Determine payload type and prepare data.
+        if "json" in step_payload:
+            try:
+                data = json.dumps(
+                    step_payload["json"],
+                    cls=JMESPathEncoder,
+                    separators=(",", ":"),
+                ).encode()
+            except AttributeError as e:
+                if cli_args.dry_run:
+                    if cli_args.force:
+                        logger.error(
+                            "Error processing playbook", error=str(e), playbook=name
+                        )
+                        step_payload["_response"] = {}
+                        continue
+                    else:
+                        raise
+                else:
+                    if retries_remaining.get() > 0:
+                        continue
+                    if cli_args.strict and isinstance(e, UnresolvedReferenceError):
+                        record_unresolved_ref(e, name, step_index)
+                        continue
+                    fail_step(name, e, "Error processing playbook")
+                    continue
+        elif "raw" in step_payload:
+            if isinstance(step_payload["raw"], str):
+                data = step_payload["raw"].encode("utf-8")
+            else:
+                data = str(step_payload["raw"]).encode("utf-8")
+        else:
+            # Send empty payload if neither json nor raw specified
+            data = b""
+
+        if "json" in step_payload:
+            format_errors = check_field_formats(playbook, json.loads(data))
+            if format_errors:
+                error = ValueError(
+                    f"Playbook '{name}' step {step_index} payload is invalid: "
+                    f"{'; '.join(format_errors)}"
+                )
+                fail_step(name, error, "Step payload is invalid", step_payload)
+                continue
+
+        if cli_args.dry_run:
+            # If we're in a dry-run, print the message instead of sending it.
+            print_dry_run_request(
+                name,
+                step_index,
+                f"PUB {params.subject}",
+                {},
+                data.decode(errors="replace"),
+            )
+            step_payload["_response"] = {}
+            continue
+        if cli_args.simulate:
+            step_payload["_response"] = add_simulated_fields(name, step_index, {})
+            record_step_result(name, "succeeded")
+            continue
+
+        await asyncio.sleep(get_delay_seconds(step_payload.get("_delay")))
+        await asyncio.sleep(get_rate_limit_delay(name, playbook))
+        logger.info(
+            "Publishing NATS message",
+            playbook=name,
+            subject=params.subject,
+            data_length=len(data),
+        )
+
+        try:
+            await nats_client.publish(params.subject, data)
+            capture_exchange(
+                name,
+                step_index,
+                {"subject": params.subject, "body": data.decode(errors="replace")},
+                None,
+            )
+            # NATS publish doesn't return a response, so we create an empty one.
+            step_payload["_response"] = {}
+            record_step_result(name, "succeeded")
+        except Exception as e:
+            fail_step(name, e, "NATS publish failed", step_payload)
+            continue
+
+
+async def run_nats_kv_put_playbook(name: str, playbook: dict) -> None:
+    """Run a playbook of type 'nats-kv-put'."""
+    cli_args = args.get()
+
+    # Initialize NATS connection if needed (simulated runs never connect).
+    if not cli_args.simulate:
+        await initialize_nats_connection()
+        if jetstream_client is None:
+            if cli_args.force:
+                logger.error("NATS JetStream client not connected", playbook=name)
+                return
+            raise AttributeError("NATS JetStream client not connected")
+
+    if "params" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing params", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing params")
+
+    params = NatsKvPutPlaybookParams.model_validate_json(
+        json.dumps(
+            playbook["params"],
+            cls=JMESPathEncoder,
+            separators=(",", ":"),
+        )
+    )
+
+    # Get or create the KV bucket.
+    kv_client = None
+    try:
+        if not cli_args.simulate:
+            kv_client = await jetstream_client.key_value(params.bucket)
+    except Exception as e:
+        if cli_args.force:
+            logger.error(
+                "Failed to access KV bucket",
+                bucket=params.bucket,
+                error=str(e),
+                playbook=name,
+            )
+            return
+        raise
+
+    if "steps" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing steps", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing steps")
+
+    for step_index, step_payload in enumerate(playbook["steps"]):
+        if "_response" in step_payload:
+            # Skip steps that have already been run.
+            continue
+        bind_step_context(step_index, step_payload)
+        if not is_step_condition_met(step_payload):
+            continue
+
+        # Determine payload type and prepare data.
+        if "json" in step_payload:
+            try:
+                data = json.dumps(
+                    step_payload["json"],
+                    cls=JMESPathEncoder,
+                    separators=(",", ":"),
+                ).encode()
+            except AttributeError as e:
+                if cli_args.dry_run:
+                    if cli_args.force:
+                        logger.error(
+                            "Error processing playbook", error=str(e), playbook=name
+                        )
+                        step_payload["_response"] = {}
+                        continue
+                    else:
+                        raise
+                else:
+                    if retries_remaining.get() > 0:
+                        continue
+                    if cli_args.strict and isinstance(e, UnresolvedReferenceError):
+                        record_unresolved_ref(e, name, step_index)
+                        continue
+                    fail_step(name, e, "Error processing playbook")
+                    continue
+        elif "raw" in step_payload:
+            if isinstance(step_payload["raw"], str):
+                data = step_payload["raw"].encode("utf-8")
+            else:
+                data = str(step_payload["raw"]).encode("utf-8")
+        else:
+            # Send empty payload if neither json nor raw specified
+            data = b""
+
+        if "json" in step_payload:
+            format_errors = check_field_formats(playbook, json.loads(data))
+            if format_errors:
+                error = ValueError(
+                    f"Playbook '{name}' step {step_index} payload is invalid: "
+                    f"{'; '.join(format_errors)}"
+                )
+                fail_step(name, error, "Step payload is invalid", step_payload)
+                continue
+
+        if cli_args.dry_run:
+            # If we're in a dry-run, print the message instead of sending it.
+            print_dry_run_request(
+                name,
+                step_index,
+                f"KV PUT {params.bucket} {params.key}",
+                {},
+                data.decode(errors="replace"),
+            )
+            step_payload["_response"] = {}
+            continue
+        if cli_args.simulate:
+            step_payload["_response"] = add_simulated_fields(name, step_index, {})
+            record_step_result(name, "succeeded")
+            continue
+
+        await asyncio.sleep(get_delay_seconds(step_payload.get("_delay")))
+        await asyncio.sleep(get_rate_limit_delay(name, playbook))
+        logger.info(
+            "Putting NATS KV entry",
+            playbook=name,
+            key=params.key,
+            data_length=len(data),
+        )
+
+        try:
+            await kv_client.put(params.key, data)
+            capture_exchange(
+                name,
+                step_index,
+                {
+                    "bucket": params.bucket,
+                    "key": params.key,
+                    "body": data.decode(errors="replace"),
+                },
+                None,
+            )
+            # NATS KV put doesn't return a response, so we create an empty one.
+            step_payload["_response"] = {}
+            record_step_result(name, "succeeded")
+        except Exception as e:
+            fail_step(name, e, "NATS KV put failed", step_payload)
+            continue
+
+
+async def run_nats_request_playbook(name: str, playbook: dict) -> None:
+    """Run a playbook of type 'nats-request'."""
+    cli_args = args.get()
+
+    # Initialize NATS connection if needed (simulated runs never connect).
+    if not cli_args.simulate:
+        await initialize_nats_connection()
+        if nats_client is None:
+            if cli_args.force:
+                logger.error("NATS client not connected", playbook=name)
+                return
+            raise AttributeError("NATS client not connected")
+
+    if "params" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing params", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing params")
+
+    params = NatsRequestPlaybookParams.model_validate_json(
+        json.dumps(
+            playbook["params"],
+            cls=JMESPathEncoder,
+            separators=(",", ":"),
+        )
+    )
+
+    if "steps" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing steps", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing steps")
+
+    for step_index, step_payload in enumerate(playbook["steps"]):
+        if "_response" in step_payload:
+            # Skip steps that have already been run.
+            continue
+        bind_step_context(step_index, step_payload)
+        if not is_step_condition_met(step_payload):
+            continue
+
+        # Determine payload type and prepare data.
+        if "json" in step_payload:
+            try:
+                data = json.dumps(
+                    step_payload["json"],
+                    cls=JMESPathEncoder,
+                    separators=(",", ":"),
+                ).encode()
+            except AttributeError as e:
+                if cli_args.dry_run:
+                    if cli_args.force:
+                        logger.error(
+                            "Error processing playbook", error=str(e), playbook=name
+                        )
+                        step_payload["_response"] = {}
+                        continue
+                    else:
+                        raise
+                else:
+                    if retries_remaining.get() > 0:
+                        continue
+                    if cli_args.strict and isinstance(e, UnresolvedReferenceError):
+                        record_unresolved_ref(e, name, step_index)
+                        continue
+                    fail_step(name, e, "Error processing playbook")
+                    continue
+        elif "raw" in step_payload:
+            if isinstance(step_payload["raw"], str):
+                data = step_payload["raw"].encode("utf-8")
+            else:
+                data = str(step_payload["raw"]).encode("utf-8")
+        else:
+            # Send empty payload if neither json nor raw specified
+            data = b""
+
+        if "json" in step_payload:
+            format_errors = check_field_formats(playbook, json.loads(data))
+            if format_errors:
+                error = ValueError(
+                    f"Playbook '{name}' step {step_index} payload is invalid: "
+                    f"{'; '.join(format_errors)}"
+                )
+                fail_step(name, error, "Step payload is invalid", step_payload)
+                continue
+
+        if cli_args.dry_run:
+            # If we're in a dry-run, print the message instead of sending it.
+            print_dry_run_request(
+                name,
+                step_index,
+                f"REQUEST {params.subject}",
+                {},
+                data.decode(errors="replace"),
+            )
+            step_payload["_response"] = {}
+            continue
+        if cli_args.simulate:
+            step_payload["_response"] = str(uuid.uuid4())
+            record_step_result(name, "succeeded")
+            continue
+
+        await asyncio.sleep(get_delay_seconds(step_payload.get("_delay")))
+        await asyncio.sleep(get_rate_limit_delay(name, playbook))
+        logger.info(
+            "Sending NATS request",
+            playbook=name,
+            subject=params.subject,
+            data_length=len(data),
+            timeout=params.timeout,
+        )
+
+        try:
+            request_started = time.monotonic()
+            response = await nats_client.request(
+                params.subject, data, timeout=params.timeout
+            )
+            capture_exchange(
+                name,
+                step_index,
+                {"subject": params.subject, "body": data.decode(errors="replace")},
+                {"body": response.data.decode(errors="replace")},
+            )
+            check_response_expectations(
+                name,
+                playbook,
+                (time.monotonic() - request_started) * 1000,
+                len(response.data),
+            )
+            # Parse the response data and store it.
+            try:
+                response_data = json.loads(response.data.decode())
+                step_payload["_response"] = response_data
+            except json.JSONDecodeError:
+                # If response is not JSON, store it as a string.
+                step_payload["_response"] = response.data.decode()
+            record_step_result(name, "succeeded")
+        except TimeoutError as e:
+            fail_step(name, e, "NATS request timeout", step_payload)
+            continue
+        except Exception as e:
+            fail_step(name, e, "NATS request failed", step_payload)
+            continue
+
+
+async def run_nats_expect_playbook(name: str, playbook: dict) -> None:
+    """Run a playbook of type 'nats-expect'.
+
+    Each step waits for a message whose body matches its JMESPath 'filter' (any
+    message, without one), storing the message in `_response`. A message only
+    satisfies one step.
+    """
+    cli_args = args.get()
+
+    # Initialize NATS connection if needed (simulated runs never connect).
+    if not cli_args.simulate:
+        await initialize_nats_connection()
+        if nats_client is None:
+            if cli_args.force:
+                logger.error("NATS client not connected", playbook=name)
+                return
+            raise AttributeError("NATS client not connected")
+
+    if "params" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing params", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing params")
+
+    params = NatsExpectPlaybookParams.model_validate_json(
+        json.dumps(
+            playbook["params"],
+            cls=JMESPathEncoder,
+            separators=(",", ":"),
+        )
+    )
+
+    if "steps" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing steps", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing steps")
+
+    pending = {}
+    filters = {}
+    for step_index, step_payload in enumerate(playbook["steps"]):
+        if "_response" in step_payload:
+            # Skip steps that have already been run.
+            continue
+        bind_step_context(step_index, step_payload)
+        if not is_step_condition_met(step_payload):
+            continue
+        try:
+            filters[step_index] = json.loads(
+                json.dumps(step_payload.get("filter"), cls=JMESPathEncoder)
+            )
+        except AttributeError as e:
+            if cli_args.dry_run:
+                if cli_args.force:
+                    logger.error(
+                        "Error processing playbook", error=str(e), playbook=name
+                    )
+                    step_payload["_response"] = {}
+                    continue
+                else:
+                    raise
+            else:
+                if retries_remaining.get() > 0:
+                    continue
+                if cli_args.strict and isinstance(e, UnresolvedReferenceError):
+                    record_unresolved_ref(e, name, step_index)
+                    continue
+                fail_step(name, e, "Error processing playbook")
+                continue
+        if cli_args.dry_run or cli_args.simulate:
+            logger.info(
+                "Skipping message check",
+                playbook=name,
+                subject=params.subject,
+                filter=filters[step_index],
+            )
+            step_payload["_response"] = {}
+            if cli_args.simulate:
+                record_step_result(name, "succeeded")
+            continue
+        pending[step_index] = step_payload
+    structlog.contextvars.unbind_contextvars("step", "label")
+    if not pending:
+        return
+
+    messages: asyncio.Queue = asyncio.Queue()
+
+    async def on_message(message) -> None:
+        await messages.put(message)
+
+    logger.info(
+        "Waiting for messages",
+        playbook=name,
+        subject=params.subject,
+        stream=params.stream,
+        count=len(pending),
+        timeout=params.timeout,
+    )
+    if params.stream is None:
+        subscription = await nats_client.subscribe(params.subject, cb=on_message)
+    else:
+        subscription = await jetstream_client.subscribe(
+            params.subject,
+            stream=params.stream,
+            cb=on_message,
+            config=ConsumerConfig(
+                deliver_policy=DeliverPolicy.BY_START_TIME,
+                opt_start_time=run_started_at.isoformat(),
+            ),
+        )
+    deadline = time.monotonic() + params.timeout
+    try:
+        while pending:
+            try:
+                message = await asyncio.wait_for(
+                    messages.get(), deadline - time.monotonic()
+                )
+            except asyncio.TimeoutError:
+                break
+            body = message.data.decode(errors="replace")
+            try:
+                body = json.loads(body)
+            except json.JSONDecodeError:
+                # If the message is not JSON, match it as a string.
+                pass
+            for step_index, step_payload in pending.items():
+                expression = filters[step_index]
+                if expression is None or jmespath.search(expression, body):
+                    bind_step_context(step_index, step_payload)
+                    logger.info("Expected message received", playbook=name)
+                    step_payload["_response"] = body
+                    record_step_result(name, "succeeded")
+                    del pending[step_index]
+                    break
+    finally:
+        await subscription.unsubscribe()
+
+    if pending:
+        error = TimeoutError(
+            f"Playbook '{name}' steps {sorted(pending)} did not receive a "
+            f"matching message after {params.timeout:g}s"
+        )
+        fail_step(name, error, "Expected messages not received", *pending.values())
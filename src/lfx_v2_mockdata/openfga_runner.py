@@ -0,0 +1,150 @@
+# Copyright The Linux Foundation and each contributor to LFX.
+# SPDX-License-Identifier: MIT
+
+"""Run playbooks of type 'openfga-bootstrap'."""
+
+import json
+import uuid
+
+import requests
+
+from . import (
+    JMESPathEncoder,
+    OpenfgaBootstrapPlaybookParams,
+    add_simulated_fields,
+    args,
+    bind_step_context,
+    fail_step,
+    get_http_session,
+    get_proxies,
+    get_request_timeout,
+    get_tls_options,
+    is_step_condition_met,
+    logger,
+    record_http_status,
+    record_step_result,
+)
+
+
+def run_openfga_bootstrap_playbook(name: str, playbook: dict) -> None:
+    """Run a playbook of type 'openfga-bootstrap'.
+
+    The store is looked up by name and created if missing, and the model is
+    only written when it differs from the store's latest one, so re-runs reuse
+    both. The IDs are stored in `_response` as "store_id" and
+    "authorization_model_id". A bootstrap playbook without steps runs once.
+    """
+    cli_args = args.get()
+    if "params" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing params", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing params")
+    params = OpenfgaBootstrapPlaybookParams.model_validate_json(
+        json.dumps(
+            playbook["params"],
+            cls=JMESPathEncoder,
+            separators=(",", ":"),
+        )
+    )
+    playbook.setdefault("steps", [{}])
+    for step_index, step_payload in enumerate(playbook["steps"]):
+        if "_response" in step_payload:
+            # Skip steps that have already been run.
+            continue
+        bind_step_context(step_index, step_payload)
+        if not is_step_condition_met(step_payload):
+            continue
+        if cli_args.dry_run:
+            logger.info("Skipping OpenFGA bootstrap", playbook=name)
+            step_payload["_response"] = {}
+            continue
+        if cli_args.simulate:
+            step_payload["_response"] = add_simulated_fields(
+                name,
+                step_index,
+                {
+                    "store_id": str(uuid.uuid4()),
+                    "authorization_model_id": str(uuid.uuid4()),
+                },
+            )
+            record_step_result(name, "succeeded")
+            continue
+        try:
+            step_payload["_response"] = bootstrap_openfga(name, params)
+            record_step_result(name, "succeeded")
+        except (OSError, requests.exceptions.RequestException) as e:
+            fail_step(name, e, "OpenFGA bootstrap failed", step_payload)
+            continue
+
+
+def bootstrap_openfga(name: str, params: OpenfgaBootstrapPlaybookParams) -> dict:
+    """Find or create an OpenFGA store and write its authorization model."""
+    model_path = params.model or args.get().fga_model
+    if model_path is None:
+        raise FileNotFoundError("No model file in params.model or --fga-model")
+    with open(model_path, encoding="utf-8") as f:
+        model = json.load(f)
+    model = model.get("authorization_model", model)
+    model = {
+        key: model[key]
+        for key in ["schema_version", "type_definitions", "conditions"]
+        if key in model
+    }
+    api_url = params.api_url.rstrip("/")
+    session = get_http_session()
+    options = {
+        "headers": params.headers,
+        "timeout": get_request_timeout(params.timeout),
+        "proxies": get_proxies(params.proxy),
+        **get_tls_options(params.tls),
+    }
+
+    store_id = None
+    continuation_token = ""
+    while store_id is None:
+        response = session.get(
+            f"{api_url}/stores",
+            params={"continuation_token": continuation_token},
+            **options,
+        )
+        record_http_status(response.status_code)
+        response.raise_for_status()
+        body = response.json()
+        for store in body.get("stores") or []:
+            if store["name"] == params.store_name:
+                store_id = store["id"]
+                break
+        continuation_token = body.get("continuation_token")
+        if not continuation_token:
+            break
+    if store_id is None:
+        logger.info("Creating OpenFGA store", playbook=name, store=params.store_name)
+        response = session.post(
+            f"{api_url}/stores", json={"name": params.store_name}, **options
+        )
+        record_http_status(response.status_code)
+        response.raise_for_status()
+        store_id = response.json()["id"]
+
+    response = session.get(
+        f"{api_url}/stores/{store_id}/authorization-models",
+        params={"page_size": 1},
+        **options,
+    )
+    record_http_status(response.status_code)
+    response.raise_for_status()
+    latest_models = response.json().get("authorization_models") or []
+    if latest_models and all(
+        latest_models[0].get(key) == value for key, value in model.items()
+    ):
+        model_id = latest_models[0]["id"]
+    else:
+        logger.info("Writing OpenFGA authorization model", playbook=name)
+        response = session.post(
+            f"{api_url}/stores/{store_id}/authorization-models", json=model, **options
+        )
+        record_http_status(response.status_code)
+        response.raise_for_status()
+        model_id = response.json()["authorization_model_id"]
+    return {"store_id": store_id, "authorization_model_id": model_id}
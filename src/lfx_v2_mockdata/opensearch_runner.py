@@ -0,0 +1,186 @@
+# Copyright The Linux Foundation and each contributor to LFX.
+# SPDX-License-Identifier: MIT
+
+"""Run playbooks of type 'opensearch'."""
+
+import json
+import time
+
+import jmespath
+import requests
+import structlog
+
+from . import (
+    JMESPathEncoder,
+    OpensearchPlaybookParams,
+    UnresolvedReferenceError,
+    add_simulated_fields,
+    args,
+    bind_step_context,
+    capture_exchange,
+    check_field_formats,
+    fail_step,
+    get_http_session,
+    get_proxies,
+    get_rate_limit_delay,
+    get_request_timeout,
+    get_tls_options,
+    is_step_condition_met,
+    logger,
+    print_dry_run_request,
+    record_http_status,
+    record_step_result,
+    record_unresolved_ref,
+    redact_headers,
+    retries_remaining,
+)
+
+
+def run_opensearch_playbook(name: str, playbook: dict) -> None:
+    """Run a playbook of type 'opensearch'.
+
+    All steps that are ready are indexed in a single _bulk request, and each
+    step's `_response` is its item from the bulk response.
+    """
+    cli_args = args.get()
+    if "params" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing params", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing params")
+    params = OpensearchPlaybookParams.model_validate_json(
+        json.dumps(
+            playbook["params"],
+            cls=JMESPathEncoder,
+            separators=(",", ":"),
+        )
+    )
+    if "steps" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing steps", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing steps")
+    pending = []
+    lines = []
+    for step_index, step_payload in enumerate(playbook["steps"]):
+        if "_response" in step_payload:
+            # Skip steps that have already been run.
+            continue
+        bind_step_context(step_index, step_payload)
+        if not is_step_condition_met(step_payload):
+            continue
+        try:
+            document = json.loads(
+                json.dumps(step_payload.get("json", {}), cls=JMESPathEncoder)
+            )
+        except AttributeError as e:
+            if cli_args.dry_run:
+                if cli_args.force:
+                    logger.error(
+                        "Error processing playbook", error=str(e), playbook=name
+                    )
+                    step_payload["_response"] = {}
+                    continue
+                else:
+                    raise
+            else:
+                if retries_remaining.get() > 0:
+                    continue
+                if cli_args.strict and isinstance(e, UnresolvedReferenceError):
+                    record_unresolved_ref(e, name, step_index)
+                    continue
+                fail_step(name, e, "Error processing playbook")
+                continue
+        payload_errors = check_field_formats(playbook, document)
+        document_id = None
+        if params.id is not None:
+            document_id = jmespath.search(params.id, document)
+            if document_id is None:
+                # Indexing it under "None" would overwrite other such documents.
+                payload_errors.append(f"document has no id at '{params.id}'")
+        if payload_errors:
+            error = ValueError(
+                f"Playbook '{name}' step {step_index} payload is invalid: "
+                f"{'; '.join(payload_errors)}"
+            )
+            fail_step(name, error, "Step payload is invalid", step_payload)
+            continue
+        action = {"_index": step_payload.get("_index", params.index)}
+        if document_id is not None:
+            action["_id"] = str(document_id)
+        lines.append(json.dumps({"index": action}, separators=(",", ":")))
+        lines.append(json.dumps(document, separators=(",", ":")))
+        pending.append(step_payload)
+    structlog.contextvars.unbind_contextvars("step", "label")
+    if not pending:
+        return
+
+    url = f"{params.url.rstrip('/')}/_bulk"
+    query_params = {"refresh": "true"} if params.refresh else {}
+    headers = {"Content-Type": "application/x-ndjson"} | params.headers
+    body = "\n".join(lines) + "\n"
+    if cli_args.dry_run:
+        # If we're in a dry-run, print the request instead of sending it.
+        print_dry_run_request(name, 0, f"POST {url}", headers, body)
+        for step_payload in pending:
+            step_payload["_response"] = {}
+        return
+    if cli_args.simulate:
+        for step_index, step_payload in enumerate(playbook["steps"]):
+            if any(step_payload is pending_step for pending_step in pending):
+                step_payload["_response"] = add_simulated_fields(name, step_index, {})
+                record_step_result(name, "succeeded")
+        return
+
+    time.sleep(get_rate_limit_delay(name, playbook))
+    logger.info("Indexing documents", playbook=name, url=url, count=len(pending))
+    request = {
+        "method": "POST",
+        "url": url,
+        "headers": redact_headers(headers),
+        "body": body,
+    }
+    try:
+        response = get_http_session().post(
+            url,
+            headers=headers,
+            params=query_params,
+            data=body.encode(),
+            timeout=get_request_timeout(params.timeout),
+            proxies=get_proxies(params.proxy),
+            **get_tls_options(params.tls),
+        )
+        capture_exchange(
+            name,
+            0,
+            request,
+            {
+                "status": response.status_code,
+                "headers": redact_headers(response.headers),
+                "body": response.text,
+            },
+        )
+        record_http_status(response.status_code)
+        response.raise_for_status()
+        items = response.json().get("items", [])
+    except requests.exceptions.RequestException as e:
+        if e.response is None:
+            capture_exchange(name, 0, request, {"error": str(e)})
+        fail_step(name, e, "Bulk request failed", *pending)
+        return
+    if len(items) != len(pending):
+        error = ValueError(
+            f"Playbook '{name}' bulk response has {len(items)} items for "
+            f"{len(pending)} documents"
+        )
+        fail_step(name, error, "Bulk request failed", *pending)
+        return
+    for step_payload, item in zip(pending, items):
+        # Each item is keyed by its action, e.g. {"index": {"_id": ...}}.
+        result = next(iter(item.values()))
+        step_payload["_response"] = result
+        if "error" in result:
+            logger.error("Document not indexed", error=result["error"], playbook=name)
+            record_step_result(name, "failed")
+        else:
+            record_step_result(name, "succeeded")
@@ -0,0 +1,208 @@
+# Copyright The Linux Foundation and each contributor to LFX.
+# SPDX-License-Identifier: MIT
+
+"""Run playbooks of type 'sql'."""
+
+import json
+import math
+import os
+import time
+from typing import Any
+
+from . import (
+    SQL_STEP_KEYS,
+    JMESPathEncoder,
+    SqlPlaybookParams,
+    UnresolvedReferenceError,
+    add_simulated_fields,
+    args,
+    bind_step_context,
+    fail_step,
+    get_delay_seconds,
+    is_step_condition_met,
+    logger,
+    print_dry_run_request,
+    record_step_result,
+    record_unresolved_ref,
+    retries_remaining,
+)
+
+
+def run_sql_playbook(name: str, playbook: dict) -> None:
+    """Run a playbook of type 'sql'.
+
+    Each step is either a 'sql' statement using query parameters (such as
+    %(slug)s) set from 'vars', or a 'table' and 'row' map to insert. Returned
+    rows are stored in `_response` as mappings of column names to values.
+    """
+    cli_args = args.get()
+    if "params" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing params", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing params")
+    params = SqlPlaybookParams.model_validate_json(
+        json.dumps(
+            playbook["params"],
+            cls=JMESPathEncoder,
+            separators=(",", ":"),
+        )
+    )
+    if "steps" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing steps", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing steps")
+    for step_index, step_payload in enumerate(playbook["steps"]):
+        if "_response" in step_payload:
+            # Skip steps that have already been run.
+            continue
+        bind_step_context(step_index, step_payload)
+        if not is_step_condition_met(step_payload):
+            continue
+        try:
+            step = json.loads(
+                json.dumps(
+                    {
+                        key: value
+                        for key, value in step_payload.items()
+                        if key in SQL_STEP_KEYS
+                    },
+                    cls=JMESPathEncoder,
+                )
+            )
+            statement, variables = get_sql_statement(step)
+        except (AttributeError, ValueError) as e:
+            if cli_args.dry_run:
+                if cli_args.force:
+                    logger.error(
+                        "Error processing playbook", error=str(e), playbook=name
+                    )
+                    step_payload["_response"] = {}
+                    continue
+                else:
+                    raise
+            else:
+                if retries_remaining.get() > 0:
+                    continue
+                if cli_args.strict and isinstance(e, UnresolvedReferenceError):
+                    record_unresolved_ref(e, name, step_index)
+                    continue
+                fail_step(name, e, "Error processing playbook")
+                continue
+
+        if cli_args.dry_run:
+            # If we're in a dry-run, print the statement instead of running it.
+            print_dry_run_request(name, step_index, "SQL", variables or {}, statement)
+            step_payload["_response"] = {}
+            continue
+        if cli_args.simulate:
+            step_payload["_response"] = add_simulated_fields(name, step_index, {})
+            record_step_result(name, "succeeded")
+            continue
+
+        dsn = os.environ.get(params.dsn_env)
+        if not dsn:
+            error = ValueError(f"Environment variable {params.dsn_env} is not set")
+            fail_step(name, error, "Database URL not set", step_payload)
+            continue
+        connect_options: dict[str, Any] = {}
+        if params.timeout is not None:
+            connect_options["connect_timeout"] = max(math.ceil(params.timeout), 1)
+            connect_options["options"] = (
+                f"-c statement_timeout={int(params.timeout * 1000)}"
+            )
+
+        # psycopg is only imported here, so that it is only needed by runs
+        # with sql steps (and not by dry runs of them).
+        try:
+            import psycopg
+            from psycopg.rows import dict_row
+            from psycopg.types.json import Jsonb
+        except ImportError as e:
+            raise ValueError(
+                "sql playbooks need the psycopg package "
+                "(uv pip install 'psycopg[binary]')"
+            ) from e
+        time.sleep(get_delay_seconds(step_payload.get("_delay")))
+        logger.info("Running SQL statement", playbook=name)
+        try:
+            with psycopg.connect(
+                dsn, autocommit=True, row_factory=dict_row, **connect_options
+            ) as connection:
+                if variables is not None:
+                    variables = {
+                        key: Jsonb(value) if isinstance(value, dict | list) else value
+                        for key, value in variables.items()
+                    }
+                cursor = connection.execute(statement, variables)
+                rows = cursor.fetchall() if cursor.description is not None else []
+        except psycopg.Error as e:
+            fail_step(
+                name,
+                e,
+                "SQL statement failed",
+                step_payload,
+                error=str(e).replace(dsn, "<dsn>"),
+            )
+            continue
+        # Keep JSON types (numbers, booleans, json columns and arrays), and
+        # store other values, such as timestamps and UUIDs, as strings.
+        rows = json.loads(json.dumps(rows, default=str))
+        if len(rows) == 1:
+            step_payload["_response"] = rows[0]
+        else:
+            step_payload["_response"] = rows
+        record_step_result(name, "succeeded")
+
+
+def get_sql_statement(step: dict) -> tuple[str, dict[str, Any] | None]:
+    """Get the statement and query parameters for a 'sql' playbook step.
+
+    A 'table' and 'row' step becomes an INSERT (an upsert when 'on_conflict'
+    lists the conflict columns) returning the row, or the 'returning'
+    columns. Mappings and lists are sent as jsonb. A 'sql' statement without
+    'vars' has no parameters, so a "%" in it does not need to be doubled.
+    """
+    variables = dict(step.get("vars", {}))
+    if "sql" in step:
+        return step["sql"], variables or None
+    if "table" not in step or "row" not in step:
+        raise ValueError("SQL step needs either 'sql' or 'table' and 'row'")
+
+    def quote(identifier: str) -> str:
+        # "%" is doubled, since statements with parameters use it for them.
+        return '"' + identifier.replace('"', '""').replace("%", "%%") + '"'
+
+    columns = []
+    values = []
+    for index, (column, value) in enumerate(step["row"].items()):
+        columns.append(quote(column))
+        if value is None:
+            values.append("NULL")
+            continue
+        variables[f"c{index}"] = value
+        values.append(f"%(c{index})s")
+    table = ".".join(quote(part) for part in step["table"].split("."))
+    statement = (
+        f"INSERT INTO {table} AS t ({', '.join(columns)})"
+        f" VALUES ({', '.join(values)})"
+    )
+    if "on_conflict" in step:
+        conflict = [quote(column) for column in step["on_conflict"]]
+        updates = [
+            f"{column} = EXCLUDED.{column}"
+            for column in columns
+            if column not in conflict
+        ]
+        statement += f" ON CONFLICT ({', '.join(conflict)})"
+        if updates:
+            statement += f" DO UPDATE SET {', '.join(updates)}"
+        else:
+            statement += " DO NOTHING"
+    if "returning" in step:
+        returning = [f"t.{quote(column)}" for column in step["returning"]]
+        statement += f" RETURNING {', '.join(returning)}"
+    else:
+        statement += " RETURNING t.*"
+    return statement, variables
@@ -0,0 +1,127 @@
+# Copyright The Linux Foundation and each contributor to LFX.
+# SPDX-License-Identifier: MIT
+
+"""Run playbooks of types 'wait' and 'delay'."""
+
+import asyncio
+import json
+import time
+
+import jmespath
+import requests
+
+from . import (
+    DelayPlaybookParams,
+    JMESPathEncoder,
+    WaitPlaybookParams,
+    args,
+    bind_step_context,
+    fail_step,
+    get_delay_seconds,
+    get_http_session,
+    get_proxies,
+    get_request_timeout,
+    get_request_url,
+    get_tls_options,
+    is_step_condition_met,
+    logger,
+    record_http_status,
+    record_step_result,
+)
+
+
+def run_wait_playbook(name: str, playbook: dict) -> None:
+    """Run a playbook of type 'wait'.
+
+    Each step polls until the condition is met, storing the matching response.
+    A wait playbook without steps polls once.
+    """
+    cli_args = args.get()
+    if "params" not in playbook:
+        if cli_args.force:
+            logger.error("Playbook missing params", playbook=name)
+            return
+        raise AttributeError(f"Playbook '{name}' missing params")
+    params = WaitPlaybookParams.model_validate_json(
+        json.dumps(
+            playbook["params"],
+            cls=JMESPathEncoder,
+            separators=(",", ":"),
+        )
+    )
+    playbook.setdefault("steps", [{}])
+    for step_index, step_payload in enumerate(playbook["steps"]):
+        if "_response" in step_payload:
+            # Skip steps that have already been run.
+            continue
+        bind_step_context(step_index, step_payload)
+        if not is_step_condition_met(step_payload):
+            continue
+        url = get_request_url(params, step_payload)
+        if cli_args.dry_run or cli_args.simulate:
+            logger.info("Skipping wait", playbook=name, url=url)
+            step_payload["_response"] = {}
+            continue
+        logger.info(
+            "Waiting for condition", playbook=name, url=url, condition=params.condition
+        )
+        deadline = time.monotonic() + params.max_wait
+        while True:
+            try:
+                response = get_http_session().get(
+                    url,
+                    headers=params.headers,
+                    params=params.params,
+                    timeout=get_request_timeout(params.timeout),
+                    proxies=get_proxies(params.proxy),
+                    **get_tls_options(params.tls),
+                )
+                record_http_status(response.status_code)
+                response.raise_for_status()
+                body = response.json()
+                if jmespath.search(params.condition, body):
+                    step_payload["_response"] = body
+                    record_step_result(name, "succeeded")
+                    break
+            except requests.exceptions.RequestException as e:
+                # Not ready yet (e.g. a 404 before the resource is indexed).
+                logger.debug("Wait condition not met", error=str(e), playbook=name)
+            if time.monotonic() + params.interval > deadline:
+                error = requests.exceptions.Timeout(
+                    f"Playbook '{name}' condition not met after {params.max_wait:g}s"
+                )
+                fail_step(name, error, "Wait timed out", step_payload)
+                break
+            time.sleep(params.interval)
+
+
+async def run_delay_playbook(name: str, playbook: dict) -> None:
+    """Run a playbook of type 'delay'.
+
+    A delay playbook without steps waits once, using its params.
+    """
+    cli_args = args.get()
+    params = DelayPlaybookParams.model_validate(playbook.get("params") or {})
+    playbook.setdefault("steps", [{}])
+    for step_index, step_payload in enumerate(playbook["steps"]):
+        if "_response" in step_payload:
+            # Skip steps that have already been run.
+            continue
+        bind_step_context(step_index, step_payload)
+        if not is_step_condition_met(step_payload):
+            continue
+        step_params = params.model_copy(
+            update={
+                key: value
+                for key, value in step_payload.items()
+                if key in ["seconds", "until"]
+            }
+        )
+        delay = get_delay_seconds(step_params.seconds or step_params.until)
+        if cli_args.dry_run or cli_args.simulate:
+            logger.info("Skipping delay", playbook=name, seconds=delay)
+        else:
+            logger.info("Waiting", playbook=name, seconds=delay)
+            await asyncio.sleep(delay)
+        step_payload["_response"] = {}
+        record_step_result(name, "succeeded")
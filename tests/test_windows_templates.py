@@ -0,0 +1,100 @@
+"""Tests for templates written on Windows (backslash paths, CRLF line endings)."""
+
+import contextvars
+import os
+import tempfile
+import unittest
+
+import lfx_v2_mockdata
+from lfx_v2_mockdata import UploadMockDataArgs
+
+
+def load_templates(template_dir: str):
+    """Load a template directory the way `run` does, in a fresh context."""
+
+    def load():
+        lfx_v2_mockdata.args.set(UploadMockDataArgs(template_dirs=[template_dir]))
+        lfx_v2_mockdata.retries_remaining.set(0)
+        return lfx_v2_mockdata.merge_and_preprocess_yaml_dirs([template_dir])
+
+    return contextvars.Context().run(load)
+
+
+def rename_in_templates(template_dir: str, old_name: str, new_name: str) -> bool:
+    """Load a template directory and rename one of its playbooks."""
+
+    def rename():
+        lfx_v2_mockdata.args.set(UploadMockDataArgs(template_dirs=[template_dir]))
+        lfx_v2_mockdata.retries_remaining.set(0)
+        data = lfx_v2_mockdata.merge_and_preprocess_yaml_dirs([template_dir])
+        return lfx_v2_mockdata.rename_playbook(
+            data, [template_dir], old_name, new_name
+        )
+
+    return contextvars.Context().run(rename)
+
+
+class BackslashIncludeTest(unittest.TestCase):
+    def test_include_with_backslash_path(self):
+        with tempfile.TemporaryDirectory() as template_dir:
+            os.makedirs(os.path.join(template_dir, "parts"))
+            with open(os.path.join(template_dir, "parts", "steps.yaml"), "w") as f:
+                f.write("- json:\n    slug: included\n")
+            with open(os.path.join(template_dir, "projects.yaml"), "w") as f:
+                f.write(
+                    "projects:\n"
+                    "  type: http-request\n"
+                    "  params:\n"
+                    "    url: http://localhost/projects\n"
+                    "    method: POST\n"
+                    "  steps: !include parts\\steps.yaml\n"
+                )
+
+            data = load_templates(template_dir)
+
+        self.assertEqual(data["projects"]["steps"][0]["json"], {"slug": "included"})
+
+
+class RenameLineEndingsTest(unittest.TestCase):
+    SOURCE = (
+        "parents:\r\n"
+        "  type: http-request\r\n"
+        "  params:\r\n"
+        "    url: http://localhost/projects\r\n"
+        "    method: POST\r\n"
+        "  steps:\r\n"
+        "    - json:\r\n"
+        "        slug: parent\r\n"
+        "children:\r\n"
+        "  type: http-request\r\n"
+        "  params:\r\n"
+        "    url: http://localhost/projects\r\n"
+        "    method: POST\r\n"
+        "  steps:\r\n"
+        "    - json:\r\n"
+        "        slug: child\r\n"
+        "        parent_uid: !ref parents.steps[0]._response.uid\r\n"
+    )
+
+    def test_rename_preserves_crlf(self):
+        with tempfile.TemporaryDirectory() as template_dir:
+            template_file = os.path.join(template_dir, "projects.yaml")
+            with open(template_file, "wb") as f:
+                f.write(self.SOURCE.encode())
+
+            renamed = rename_in_templates(template_dir, "parents", "root_projects")
+            with open(template_file, "rb") as f:
+                result = f.read().decode()
+
+        self.assertTrue(renamed)
+        self.assertEqual(
+            result,
+            self.SOURCE.replace("parents:", "root_projects:").replace(
+                "!ref parents.", "!ref root_projects."
+            ),
+        )
+        self.assertNotIn("\n", result.replace("\r\n", ""))
+
+
+if __name__ == "__main__":
+    unittest.main()